@@ -1,6 +1,9 @@
 package gommand
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/andersfylling/disgord"
 )
 
@@ -17,9 +20,16 @@ type MessageCacheStorageAdapter interface {
 	GetAndDelete(ChannelID, MessageID disgord.Snowflake) *disgord.Message
 	Delete(ChannelID, MessageID disgord.Snowflake)
 	DeleteChannelsMessages(ChannelID disgord.Snowflake)
-	Set(ChannelID, MessageID disgord.Snowflake, Message *disgord.Message, Limit uint)
+	// Set stores a message, honouring both the count-based Limit and, if non-zero, the MaxAge
+	// eviction policy (e.g. via Redis EXPIRE or a periodic sweeper started in Init()).
+	Set(ChannelID, MessageID disgord.Snowflake, Message *disgord.Message, Limit uint, MaxAge time.Duration)
 	Update(ChannelID, MessageID disgord.Snowflake, Message *disgord.Message) (old *disgord.Message)
 
+	// MutateReactions fetches the cached message, calls fn with it so the caller can mutate its
+	// Reactions in place, then stores it back. It's a no-op if the message isn't cached. This
+	// exists so that reaction events don't race a full get/set pair against other mutations.
+	MutateReactions(ChannelID, MessageID disgord.Snowflake, fn func(*disgord.Message))
+
 	// Handles guild removal. The behaviour of this changes depending on if GuildChannelRelationshipManagement is implemented.
 	// If it is, this will just be used to remove all guild/channel relationships but not messages from the cache (that'll be done by running DeleteChannelsMessages with each channel ID).
 	// If it isn't, it will remove all of the guilds messages from the cache.
@@ -33,6 +43,22 @@ type GuildChannelRelationshipManagement interface {
 	RemoveChannelID(GuildID, ChannelID disgord.Snowflake)
 }
 
+// MessageHistoryStorageAdapter is an optional set of functions which a struct implementing
+// MessageCacheStorageAdapter can use to retain the full edit history of a message, rather than
+// just the single previous version Update returns. It's discovered via type assertion, the same
+// way GuildChannelRelationshipManagement is.
+type MessageHistoryStorageAdapter interface {
+	// AppendVersion records a new version of a message, stamped with its edited_timestamp (or
+	// time.Now() if the gateway didn't provide one).
+	AppendVersion(ChannelID, MessageID disgord.Snowflake, Message *disgord.Message)
+
+	// GetVersions returns every version stored for a message, oldest first.
+	GetVersions(ChannelID, MessageID disgord.Snowflake) []*disgord.Message
+
+	// TrimVersions discards all but the newest Keep versions of a message.
+	TrimVersions(ChannelID, MessageID disgord.Snowflake, Keep int)
+}
+
 // MessageCacheHandler is used to handle dispatching events for deleted/edited messages.
 // It does this by using the storage adapter to log messages, then the message is deleted from the database at the message limit or when the deleted message handler is called.
 type MessageCacheHandler struct {
@@ -41,10 +67,38 @@ type MessageCacheHandler struct {
 	DeletedCallback            func(s disgord.Session, msg *disgord.Message)                                     `json:"-"`
 	UpdatedCallback            func(s disgord.Session, before, after *disgord.Message)                           `json:"-"`
 
+	// HistoryUpdatedCallback, if set, is called instead of UpdatedCallback whenever the storage
+	// adapter implements MessageHistoryStorageAdapter, passing every retained version of the
+	// message (oldest first, newest last) rather than just the single previous version.
+	HistoryUpdatedCallback func(s disgord.Session, versions []*disgord.Message) `json:"-"`
+
+	// ReactionRemovedCallback, if set, is called when a single reaction is removed from a cached
+	// message, mirroring DeletedCallback. The message passed is the fully-hydrated cached message
+	// after the reaction has been removed from it.
+	ReactionRemovedCallback func(s disgord.Session, msg *disgord.Message, remover *disgord.User) `json:"-"`
+
+	// StateCache, if set, is consulted for member data before falling back to the REST API. This
+	// avoids rate-limited requests that often fail anyway for users who have since left the guild.
+	StateCache *StateCacheHandler `json:"-"`
+
 	// Limit defines the amount of messages.
 	// -1 = unlimited (not suggested if it's in-memory since it'll lead to memory leaks), 0 = default, >0 = user set maximum
 	Limit int `json:"limit"`
 
+	// HistoryLimit defines the amount of versions kept per message when the storage adapter
+	// implements MessageHistoryStorageAdapter. 0 = history tracking disabled, >0 = user set maximum.
+	HistoryLimit int `json:"historyLimit"`
+
+	// MaxAge defines how long a message is kept in the cache regardless of Limit. 0 = no age
+	// based eviction. Expiry is handled entirely by the storage adapter (e.g. a sweeper goroutine
+	// or Redis EXPIRE) and never fires DeletedCallback - expired messages just silently disappear.
+	MaxAge time.Duration `json:"maxAge"`
+
+	// MaxBytes defines the maximum size, in bytes, of a message's content plus its embeds and
+	// attachments (all as JSON) before it's skipped entirely rather than cached. 0 = no size
+	// limit. This guards against pathological attachments/embeds bloating the cache.
+	MaxBytes int `json:"maxBytes"`
+
 	// IgnoreBots is whether or not messages from bots should be excluded from the message cache.
 	IgnoreBots bool `json:"ignoreBots"`
 }
@@ -96,12 +150,69 @@ func (d *MessageCacheHandler) guildCreate(_ disgord.Session, evt *disgord.GuildC
 	}()
 }
 
+// emojiMatches returns true if a cached reaction's emoji is the same as the one from a gateway event.
+func emojiMatches(a, b *disgord.PartialEmoji) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if a.ID != 0 || b.ID != 0 {
+		return a.ID == b.ID
+	}
+	return a.Name == b.Name
+}
+
+// addReaction increments (or creates) the reaction entry for an emoji on a cached message.
+func addReaction(msg *disgord.Message, emoji *disgord.PartialEmoji) {
+	for _, r := range msg.Reactions {
+		if emojiMatches(r.Emoji, emoji) {
+			r.Count++
+			return
+		}
+	}
+	msg.Reactions = append(msg.Reactions, &disgord.Reaction{Count: 1, Emoji: emoji})
+}
+
+// removeReaction decrements the reaction entry for an emoji on a cached message, removing it
+// entirely once its count reaches zero.
+func removeReaction(msg *disgord.Message, emoji *disgord.PartialEmoji) {
+	for i, r := range msg.Reactions {
+		if emojiMatches(r.Emoji, emoji) {
+			r.Count--
+			if r.Count <= 0 {
+				msg.Reactions = append(msg.Reactions[:i], msg.Reactions[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// removeReactionEmoji removes every reaction of a given emoji from a cached message.
+func removeReactionEmoji(msg *disgord.Message, emoji *disgord.PartialEmoji) {
+	for i, r := range msg.Reactions {
+		if emojiMatches(r.Emoji, emoji) {
+			msg.Reactions = append(msg.Reactions[:i], msg.Reactions[i+1:]...)
+			return
+		}
+	}
+}
+
+// resolveMember looks up a guild member, preferring the state cache (if set) over the REST API
+// since the latter is rate-limited and often fails for users who have since left the guild.
+func (d *MessageCacheHandler) resolveMember(s disgord.Session, guildID, userID disgord.Snowflake) (*disgord.Member, error) {
+	if d.StateCache != nil && d.StateCache.StateStorageAdapter != nil {
+		if member := d.StateCache.StateStorageAdapter.Member(guildID, userID); member != nil {
+			return member, nil
+		}
+	}
+	return s.Guild(guildID).Member(userID).Get()
+}
+
 // Defines the message deletion handler.
 func (d *MessageCacheHandler) messageDelete(s disgord.Session, evt *disgord.MessageDelete) {
 	go func() {
 		msg := d.MessageCacheStorageAdapter.GetAndDelete(evt.ChannelID, evt.MessageID)
 		if msg != nil && d.DeletedCallback != nil {
-			member, err := s.Guild(msg.GuildID).Member(msg.Author.ID).Get()
+			member, err := d.resolveMember(s, msg.GuildID, msg.Author.ID)
 			if err == nil {
 				member.GuildID = evt.GuildID
 				msg.Member = member
@@ -119,18 +230,42 @@ func (d *MessageCacheHandler) messageDelete(s disgord.Session, evt *disgord.Mess
 	}()
 }
 
+// messageSize returns the combined byte size of a message's content, embeds and attachments
+// (all as JSON), used to enforce MaxBytes.
+func messageSize(msg *disgord.Message) int {
+	size := len(msg.Content)
+	for _, e := range msg.Embeds {
+		b, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		size += len(b)
+	}
+	for _, a := range msg.Attachments {
+		b, err := json.Marshal(a)
+		if err != nil {
+			continue
+		}
+		size += len(b)
+	}
+	return size
+}
+
 // Defines the message creation handler.
 func (d *MessageCacheHandler) messageCreate(_ disgord.Session, evt *disgord.MessageCreate) {
 	if d.IgnoreBots && evt.Message.Author.Bot {
 		return
 	}
+	if d.MaxBytes > 0 && messageSize(evt.Message) > d.MaxBytes {
+		return
+	}
 	Limit := d.Limit
 	if Limit == 0 {
 		Limit = defaultMessageCount
 	} else if 0 > Limit {
 		Limit = 0
 	}
-	go d.MessageCacheStorageAdapter.Set(evt.Message.ChannelID, evt.Message.ID, evt.Message, uint(Limit))
+	go d.MessageCacheStorageAdapter.Set(evt.Message.ChannelID, evt.Message.ID, evt.Message, uint(Limit), d.MaxAge)
 }
 
 // Defines the message update handler.
@@ -148,21 +283,95 @@ func (d *MessageCacheHandler) messageUpdate(s disgord.Session, evt *disgord.Mess
 			return
 		}
 		before := d.MessageCacheStorageAdapter.Update(evt.Message.ChannelID, evt.Message.ID, evt.Message)
-		if before != nil && d.UpdatedCallback != nil {
-			member, err := s.Guild(evt.Message.GuildID).Member(evt.Message.Author.ID).Get()
-			if err != nil {
-				return
+		if before == nil {
+			return
+		}
+
+		h, historyEnabled := d.MessageCacheStorageAdapter.(MessageHistoryStorageAdapter)
+		if historyEnabled && d.HistoryLimit != 0 {
+			if len(h.GetVersions(evt.Message.ChannelID, evt.Message.ID)) == 0 {
+				// Seed the chain with the pre-edit version, otherwise the first edit's history
+				// would start at v2 and the original message would never be retrievable.
+				h.AppendVersion(evt.Message.ChannelID, evt.Message.ID, before)
+			}
+			h.AppendVersion(evt.Message.ChannelID, evt.Message.ID, evt.Message)
+			if d.HistoryLimit > 0 {
+				h.TrimVersions(evt.Message.ChannelID, evt.Message.ID, d.HistoryLimit)
 			}
-			member.GuildID = evt.Message.GuildID
-			before.Member = member
-			before.Author = member.User
-			evt.Message.Member = member
-			evt.Message.Author = member.User
+		}
+
+		if d.UpdatedCallback == nil && d.HistoryUpdatedCallback == nil {
+			return
+		}
+		member, err := d.resolveMember(s, evt.Message.GuildID, evt.Message.Author.ID)
+		if err != nil {
+			return
+		}
+		member.GuildID = evt.Message.GuildID
+		before.Member = member
+		before.Author = member.User
+		evt.Message.Member = member
+		evt.Message.Author = member.User
+
+		// HistoryUpdatedCallback fires instead of UpdatedCallback, per its doc comment, rather than
+		// alongside it.
+		if d.HistoryUpdatedCallback != nil && historyEnabled {
+			d.HistoryUpdatedCallback(s, h.GetVersions(evt.Message.ChannelID, evt.Message.ID))
+		} else if d.UpdatedCallback != nil {
 			d.UpdatedCallback(s, before, evt.Message)
 		}
 	}()
 }
 
+// Defines the reaction add handler.
+func (d *MessageCacheHandler) reactionAdd(_ disgord.Session, evt *disgord.MessageReactionAdd) {
+	go d.MessageCacheStorageAdapter.MutateReactions(evt.ChannelID, evt.MessageID, func(msg *disgord.Message) {
+		addReaction(msg, evt.PartialEmoji)
+	})
+}
+
+// Defines the reaction remove handler.
+func (d *MessageCacheHandler) reactionRemove(s disgord.Session, evt *disgord.MessageReactionRemove) {
+	go func() {
+		var hydrated *disgord.Message
+		d.MessageCacheStorageAdapter.MutateReactions(evt.ChannelID, evt.MessageID, func(msg *disgord.Message) {
+			removeReaction(msg, evt.PartialEmoji)
+			hydrated = msg
+		})
+		if hydrated == nil || d.ReactionRemovedCallback == nil {
+			return
+		}
+		user, err := s.User(evt.UserID).Get()
+		if err != nil {
+			return
+		}
+		d.ReactionRemovedCallback(s, hydrated, user)
+	}()
+}
+
+// Defines the reaction remove all handler.
+func (d *MessageCacheHandler) reactionRemoveAll(_ disgord.Session, evt *disgord.MessageReactionRemoveAll) {
+	go d.MessageCacheStorageAdapter.MutateReactions(evt.ChannelID, evt.MessageID, func(msg *disgord.Message) {
+		msg.Reactions = nil
+	})
+}
+
+// Defines the reaction remove emoji handler.
+func (d *MessageCacheHandler) reactionRemoveEmoji(_ disgord.Session, evt *disgord.MessageReactionRemoveEmoji) {
+	go d.MessageCacheStorageAdapter.MutateReactions(evt.ChannelID, evt.MessageID, func(msg *disgord.Message) {
+		removeReactionEmoji(msg, evt.Emoji)
+	})
+}
+
+// Defines the channel pins update handler. Discord doesn't tell us which message was
+// pinned/unpinned here, so this only keeps the channel's LastPinTimestamp (via StateCache) fresh.
+func (d *MessageCacheHandler) channelPinsUpdate(_ disgord.Session, evt *disgord.ChannelPinsUpdate) {
+	if d.StateCache == nil || d.StateCache.StateStorageAdapter == nil {
+		return
+	}
+	go d.StateCache.StateStorageAdapter.ChannelPinTimestamp(evt.ChannelID, evt.LastPinTimestamp)
+}
+
 // Defines the message bulk delete handler.
 func (d *MessageCacheHandler) bulkDeleteHandler(s disgord.Session, evt *disgord.MessageDeleteBulk) {
 	go func() {
@@ -186,7 +395,7 @@ func (d *MessageCacheHandler) bulkDeleteHandler(s disgord.Session, evt *disgord.
 				}
 				continue
 			}
-			member, err := s.Guild(m.GuildID).Member(m.Author.ID).Get()
+			member, err := d.resolveMember(s, m.GuildID, m.Author.ID)
 			if err == nil {
 				m.Member = member
 				m.Member.GuildID = m.GuildID
@@ -0,0 +1,488 @@
+package gommand
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andersfylling/disgord"
+	"github.com/go-redis/redis/v8"
+)
+
+// defaultRedisKeyPrefix is used to namespace all keys written by RedisMessageCacheStorageAdapter.
+const defaultRedisKeyPrefix = "gommand:message-cache:"
+
+// indexSweepInterval is how often stale per-channel sorted set entries are reconciled against
+// their underlying (TTL-expired) message keys. This matters for channels that go idle after
+// MaxAge-expired messages stop getting pruned by Set - without it their index would grow forever.
+const indexSweepInterval = 10 * time.Minute
+
+// invalidationDedupTTL bounds how long a "delete" invalidation from another process is remembered,
+// so a GetAndDelete racing the pub/sub message for the same key knows to treat it as already gone.
+const invalidationDedupTTL = 30 * time.Second
+
+// getAndDeleteScript atomically fetches and removes a single cached message plus its index entry,
+// so two processes racing to handle the same MESSAGE_DELETE can't both get a non-nil result back.
+const getAndDeleteScript = `
+local v = redis.call('GET', KEYS[1])
+if v then
+	redis.call('DEL', KEYS[1])
+	redis.call('ZREM', KEYS[2], ARGV[1])
+end
+return v
+`
+
+// redisCacheInvalidation is published on the adapter's invalidation channel whenever Delete,
+// DeleteChannelsMessages or RemoveGuild runs on one process, so that every other process sharing the same Redis instance
+// can react without re-querying Redis (mirroring how Mattermost invalidates cluster-wide caches).
+type redisCacheInvalidation struct {
+	Op        string            `json:"op"`
+	ChannelID disgord.Snowflake `json:"channel_id"`
+	MessageID disgord.Snowflake `json:"message_id,omitempty"`
+	GuildID   disgord.Snowflake `json:"guild_id,omitempty"`
+	Origin    string            `json:"origin"`
+}
+
+// RedisMessageCacheStorageAdapter is a MessageCacheStorageAdapter backed by Redis, intended for
+// sharded bots which run as several separate processes and need to share a single message cache.
+// It also implements GuildChannelRelationshipManagement.
+type RedisMessageCacheStorageAdapter struct {
+	// Client is the Redis client used by this adapter. It must be set before Init is called.
+	Client *redis.Client
+
+	// KeyPrefix namespaces every key written to Redis by this adapter. Defaults to "gommand:message-cache:".
+	KeyPrefix string
+
+	// InvalidationChannel is the Redis pub/sub channel used to notify other processes of cache
+	// mutations. Defaults to KeyPrefix + "invalidate".
+	InvalidationChannel string
+
+	// OnInvalidate, if set, is called whenever an invalidation message published by another
+	// process (not this one) is received on InvalidationChannel.
+	OnInvalidate func(op string, channelID, messageID, guildID disgord.Snowflake)
+
+	ctx        context.Context
+	instanceID string
+
+	dedupMu     sync.Mutex
+	invalidated map[string]time.Time
+}
+
+// Init is called when the router is created. It fills in defaults and subscribes to the
+// invalidation channel so this process can react to mutations made by other processes.
+func (a *RedisMessageCacheStorageAdapter) Init() {
+	a.ctx = context.Background()
+	if a.KeyPrefix == "" {
+		a.KeyPrefix = defaultRedisKeyPrefix
+	}
+	if a.InvalidationChannel == "" {
+		a.InvalidationChannel = a.KeyPrefix + "invalidate"
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	a.instanceID = hex.EncodeToString(b)
+	a.invalidated = map[string]time.Time{}
+
+	go func() {
+		sub := a.Client.Subscribe(a.ctx, a.InvalidationChannel)
+		ch := sub.Channel()
+		for msg := range ch {
+			var inv redisCacheInvalidation
+			if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+				continue
+			}
+			if inv.Origin == a.instanceID {
+				// This process published it, we've already handled it locally.
+				continue
+			}
+			if inv.Op == "delete" {
+				// Another process already handled this message. Remember it briefly so that if
+				// our own GetAndDelete is racing the same deletion, it knows to treat the message
+				// as already gone rather than risk firing DeletedCallback a second time.
+				a.markInvalidated(a.messageKey(inv.ChannelID, inv.MessageID))
+			}
+			if a.OnInvalidate != nil {
+				a.OnInvalidate(inv.Op, inv.ChannelID, inv.MessageID, inv.GuildID)
+			}
+		}
+	}()
+
+	go a.sweepStaleIndexEntries()
+}
+
+// markInvalidated records that a message key was just deleted by another process.
+func (a *RedisMessageCacheStorageAdapter) markInvalidated(key string) {
+	a.dedupMu.Lock()
+	defer a.dedupMu.Unlock()
+	a.invalidated[key] = time.Now()
+	for k, t := range a.invalidated {
+		if time.Since(t) > invalidationDedupTTL {
+			delete(a.invalidated, k)
+		}
+	}
+}
+
+// wasRecentlyInvalidated reports whether another process deleted this message key recently enough
+// that this process should treat it as already gone.
+func (a *RedisMessageCacheStorageAdapter) wasRecentlyInvalidated(key string) bool {
+	a.dedupMu.Lock()
+	defer a.dedupMu.Unlock()
+	t, ok := a.invalidated[key]
+	if !ok {
+		return false
+	}
+	return time.Since(t) <= invalidationDedupTTL
+}
+
+// sweepStaleIndexEntries periodically removes per-channel sorted set members whose underlying
+// message key has already expired. Set only prunes a channel's own index when a new message
+// arrives in it, so a channel that goes quiet needs this to reclaim its now-dangling entries.
+func (a *RedisMessageCacheStorageAdapter) sweepStaleIndexEntries() {
+	ticker := time.NewTicker(indexSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var cursor uint64
+		for {
+			keys, next, err := a.Client.Scan(a.ctx, cursor, a.KeyPrefix+"chan:*", 100).Result()
+			if err != nil {
+				break
+			}
+			for _, setKey := range keys {
+				a.sweepChannelSet(setKey)
+			}
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+}
+
+// sweepChannelSet removes members of a single channel's sorted set whose message key no longer exists.
+func (a *RedisMessageCacheStorageAdapter) sweepChannelSet(setKey string) {
+	members, err := a.Client.ZRange(a.ctx, setKey, 0, -1).Result()
+	if err != nil || len(members) == 0 {
+		return
+	}
+	channelID := parseSnowflake(strings.TrimPrefix(setKey, a.KeyPrefix+"chan:"))
+	stale := make([]interface{}, 0, len(members))
+	for _, m := range members {
+		exists, err := a.Client.Exists(a.ctx, a.messageKey(channelID, parseSnowflake(m))).Result()
+		if err == nil && exists == 0 {
+			stale = append(stale, m)
+		}
+	}
+	if len(stale) > 0 {
+		a.Client.ZRem(a.ctx, setKey, stale...)
+	}
+}
+
+// publish notifies other processes that a mutation happened.
+func (a *RedisMessageCacheStorageAdapter) publish(op string, channelID, messageID, guildID disgord.Snowflake) {
+	payload, err := json.Marshal(redisCacheInvalidation{
+		Op:        op,
+		ChannelID: channelID,
+		MessageID: messageID,
+		GuildID:   guildID,
+		Origin:    a.instanceID,
+	})
+	if err != nil {
+		return
+	}
+	a.Client.Publish(a.ctx, a.InvalidationChannel, payload)
+}
+
+// messageKey returns the key that a single message is stored under.
+func (a *RedisMessageCacheStorageAdapter) messageKey(channelID, messageID disgord.Snowflake) string {
+	return a.KeyPrefix + "msg:" + channelID.String() + ":" + messageID.String()
+}
+
+// channelSetKey returns the key of the sorted set which tracks message IDs for a channel. Every
+// member shares score 0 and is instead ordered lexicographically via snowflakeMember, which is
+// itself timestamp-ordered, so that the oldest messages can be trimmed off once Limit is exceeded.
+func (a *RedisMessageCacheStorageAdapter) channelSetKey(channelID disgord.Snowflake) string {
+	return a.KeyPrefix + "chan:" + channelID.String()
+}
+
+// guildChannelsKey returns the key of the hash which tracks the channel IDs belonging to a guild.
+func (a *RedisMessageCacheStorageAdapter) guildChannelsKey(guildID disgord.Snowflake) string {
+	return a.KeyPrefix + "guild:" + guildID.String()
+}
+
+func parseSnowflake(s string) disgord.Snowflake {
+	v, _ := strconv.ParseUint(s, 10, 64)
+	return disgord.Snowflake(v)
+}
+
+// snowflakeMember renders a snowflake as a fixed-width, zero-padded decimal string. Sorted set
+// members for a given channel all share score 0 (see channelSetKey's doc comment) and are ordered
+// lexicographically instead, since a Redis score is an IEEE-754 double and can't represent a full
+// 64-bit snowflake without losing its low bits.
+func snowflakeMember(id disgord.Snowflake) string {
+	return fmt.Sprintf("%020d", uint64(id))
+}
+
+// discordEpochMs is the custom epoch (2015-01-01T00:00:00Z) that Discord snowflakes are relative to.
+const discordEpochMs = 1420070400000
+
+// snowflakeForTime returns the smallest snowflake whose embedded timestamp is t, for use (via
+// snowflakeMember) as a lexicographic sorted set range bound. It doesn't need to resolve to a real ID, only to sort correctly.
+func snowflakeForTime(t time.Time) disgord.Snowflake {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	if ms < discordEpochMs {
+		return 0
+	}
+	return disgord.Snowflake(uint64(ms-discordEpochMs) << 22)
+}
+
+// timeForSnowflake returns the creation time embedded in a snowflake ID.
+func timeForSnowflake(id disgord.Snowflake) time.Time {
+	ms := int64(uint64(id)>>22) + discordEpochMs
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// getMessage reads and unmarshals a single cached message, returning nil if it isn't present.
+func (a *RedisMessageCacheStorageAdapter) getMessage(channelID, messageID disgord.Snowflake) *disgord.Message {
+	raw, err := a.Client.Get(a.ctx, a.messageKey(channelID, messageID)).Bytes()
+	if err != nil {
+		return nil
+	}
+	msg := &disgord.Message{}
+	if err := json.Unmarshal(raw, msg); err != nil {
+		return nil
+	}
+	return msg
+}
+
+// BulkGetAndDelete fetches and removes several messages from a channel in a single round-trip.
+// Each message is fetched-and-removed atomically (via getAndDeleteScript) so a process racing
+// another one to handle the same bulk delete can't both get the same message back.
+func (a *RedisMessageCacheStorageAdapter) BulkGetAndDelete(ChannelID disgord.Snowflake, MessageIDs []disgord.Snowflake) []*disgord.Message {
+	if len(MessageIDs) == 0 {
+		return nil
+	}
+	setKey := a.channelSetKey(ChannelID)
+
+	pipe := a.Client.Pipeline()
+	cmds := make([]*redis.Cmd, len(MessageIDs))
+	for i, id := range MessageIDs {
+		key := a.messageKey(ChannelID, id)
+		if a.wasRecentlyInvalidated(key) {
+			continue
+		}
+		cmds[i] = pipe.Eval(a.ctx, getAndDeleteScript, []string{key, setKey}, snowflakeMember(id))
+	}
+	_, _ = pipe.Exec(a.ctx)
+
+	out := make([]*disgord.Message, 0, len(MessageIDs))
+	for _, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		raw, err := cmd.Text()
+		if err != nil {
+			continue
+		}
+		msg := &disgord.Message{}
+		if err := json.Unmarshal([]byte(raw), msg); err != nil {
+			continue
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+// GetAndDelete atomically fetches and removes a single message from the cache, so that two
+// processes racing to handle the same deletion (e.g. duplicate MESSAGE_DELETE handling across
+// shards) can't both get a non-nil result and both fire DeletedCallback.
+func (a *RedisMessageCacheStorageAdapter) GetAndDelete(ChannelID, MessageID disgord.Snowflake) *disgord.Message {
+	key := a.messageKey(ChannelID, MessageID)
+	if a.wasRecentlyInvalidated(key) {
+		return nil
+	}
+	raw, err := a.Client.Eval(a.ctx, getAndDeleteScript, []string{key, a.channelSetKey(ChannelID)}, snowflakeMember(MessageID)).Text()
+	if err != nil {
+		return nil
+	}
+	msg := &disgord.Message{}
+	if err := json.Unmarshal([]byte(raw), msg); err != nil {
+		return nil
+	}
+	return msg
+}
+
+// Delete removes a single message from the cache and notifies other processes.
+func (a *RedisMessageCacheStorageAdapter) Delete(ChannelID, MessageID disgord.Snowflake) {
+	pipe := a.Client.Pipeline()
+	pipe.Del(a.ctx, a.messageKey(ChannelID, MessageID))
+	pipe.ZRem(a.ctx, a.channelSetKey(ChannelID), snowflakeMember(MessageID))
+	_, _ = pipe.Exec(a.ctx)
+	a.publish("delete", ChannelID, MessageID, 0)
+}
+
+// DeleteChannelsMessages removes every cached message for a channel.
+func (a *RedisMessageCacheStorageAdapter) DeleteChannelsMessages(ChannelID disgord.Snowflake) {
+	setKey := a.channelSetKey(ChannelID)
+	members, err := a.Client.ZRange(a.ctx, setKey, 0, -1).Result()
+	if err == nil && len(members) > 0 {
+		keys := make([]string, len(members))
+		for i, m := range members {
+			keys[i] = a.messageKey(ChannelID, parseSnowflake(m))
+		}
+		pipe := a.Client.Pipeline()
+		pipe.Del(a.ctx, keys...)
+		pipe.Del(a.ctx, setKey)
+		_, _ = pipe.Exec(a.ctx)
+	} else {
+		a.Client.Del(a.ctx, setKey)
+	}
+	a.publish("deleteChannel", ChannelID, 0, 0)
+}
+
+// Set stores a message in the cache, trimming the channel's sorted set down to Limit entries and
+// expiring the message after MaxAge (if non-zero) via Redis's own EXPIRE.
+func (a *RedisMessageCacheStorageAdapter) Set(ChannelID, MessageID disgord.Snowflake, Message *disgord.Message, Limit uint, MaxAge time.Duration) {
+	raw, err := json.Marshal(Message)
+	if err != nil {
+		return
+	}
+	setKey := a.channelSetKey(ChannelID)
+
+	ttl := MaxAge
+	if MaxAge > 0 {
+		// TTL is relative to the message's own creation time, not to now, so a replayed/backlog
+		// message doesn't get a fresh full MaxAge window from the moment it happens to be cached.
+		ttl = MaxAge - time.Since(timeForSnowflake(MessageID))
+		if ttl <= 0 {
+			return
+		}
+	}
+
+	pipe := a.Client.Pipeline()
+	pipe.Set(a.ctx, a.messageKey(ChannelID, MessageID), raw, ttl)
+	// All members share score 0 and sort lexicographically instead - a float64 score can't hold a
+	// full snowflake without losing its low bits, which would corrupt both this ordering and the
+	// Limit trim below.
+	pipe.ZAdd(a.ctx, setKey, &redis.Z{Score: 0, Member: snowflakeMember(MessageID)})
+	if MaxAge > 0 {
+		// snowflakeMember is zero-padded and fixed-width, so lexicographic order matches the
+		// snowflakes' time order. This prunes members whose underlying key has already expired via
+		// Redis TTL, keeping the channel's sorted set bounded even when Limit is unbounded (0).
+		cutoff := snowflakeForTime(time.Now().Add(-MaxAge))
+		pipe.ZRemRangeByLex(a.ctx, setKey, "-", "["+snowflakeMember(cutoff))
+	}
+	_, _ = pipe.Exec(a.ctx)
+
+	if Limit == 0 {
+		return
+	}
+	count, err := a.Client.ZCard(a.ctx, setKey).Result()
+	if err != nil || count <= int64(Limit) {
+		return
+	}
+	overflow := count - int64(Limit)
+	stale, err := a.Client.ZRange(a.ctx, setKey, 0, overflow-1).Result()
+	if err != nil || len(stale) == 0 {
+		return
+	}
+	keys := make([]string, len(stale))
+	for i, m := range stale {
+		keys[i] = a.messageKey(ChannelID, parseSnowflake(m))
+	}
+	trimPipe := a.Client.Pipeline()
+	trimPipe.Del(a.ctx, keys...)
+	trimPipe.ZRemRangeByRank(a.ctx, setKey, 0, overflow-1)
+	_, _ = trimPipe.Exec(a.ctx)
+}
+
+// Update overwrites a cached message in place, returning the previous version (or nil if it
+// wasn't cached).
+func (a *RedisMessageCacheStorageAdapter) Update(ChannelID, MessageID disgord.Snowflake, Message *disgord.Message) (old *disgord.Message) {
+	old = a.getMessage(ChannelID, MessageID)
+	if old == nil {
+		return nil
+	}
+	raw, err := json.Marshal(Message)
+	if err != nil {
+		return old
+	}
+	a.Client.Set(a.ctx, a.messageKey(ChannelID, MessageID), raw, redis.KeepTTL)
+	return old
+}
+
+// maxMutateReactionsRetries bounds how many times MutateReactions retries after losing the
+// optimistic lock race on the message key to a concurrent reaction event.
+const maxMutateReactionsRetries = 10
+
+// MutateReactions fetches the cached message, lets fn mutate it, then stores it back without
+// touching its TTL. The read-modify-write is wrapped in a WATCH/MULTI transaction so concurrent
+// reaction events on the same message (e.g. an add and a remove arriving together) don't clobber
+// one another.
+func (a *RedisMessageCacheStorageAdapter) MutateReactions(ChannelID, MessageID disgord.Snowflake, fn func(*disgord.Message)) {
+	key := a.messageKey(ChannelID, MessageID)
+	for attempt := 0; attempt < maxMutateReactionsRetries; attempt++ {
+		err := a.Client.Watch(a.ctx, func(tx *redis.Tx) error {
+			raw, err := tx.Get(a.ctx, key).Bytes()
+			if err == redis.Nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			msg := &disgord.Message{}
+			if err := json.Unmarshal(raw, msg); err != nil {
+				return err
+			}
+			fn(msg)
+			updated, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(a.ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(a.ctx, key, updated, redis.KeepTTL)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return
+		}
+	}
+}
+
+// RemoveGuild removes the guild/channel relationship set for a guild. Messages are removed
+// separately by the caller via DeleteChannelsMessages, per the GuildChannelRelationshipManagement
+// contract on MessageCacheStorageAdapter.
+func (a *RedisMessageCacheStorageAdapter) RemoveGuild(GuildID disgord.Snowflake) {
+	a.Client.Del(a.ctx, a.guildChannelsKey(GuildID))
+	a.publish("removeGuild", 0, 0, GuildID)
+}
+
+// GetAllChannelIDs returns every channel ID known to belong to a guild.
+func (a *RedisMessageCacheStorageAdapter) GetAllChannelIDs(GuildID disgord.Snowflake) []disgord.Snowflake {
+	fields, err := a.Client.HKeys(a.ctx, a.guildChannelsKey(GuildID)).Result()
+	if err != nil {
+		return nil
+	}
+	ids := make([]disgord.Snowflake, len(fields))
+	for i, f := range fields {
+		ids[i] = parseSnowflake(f)
+	}
+	return ids
+}
+
+// AddChannelID records that a channel belongs to a guild.
+func (a *RedisMessageCacheStorageAdapter) AddChannelID(GuildID, ChannelID disgord.Snowflake) {
+	a.Client.HSet(a.ctx, a.guildChannelsKey(GuildID), ChannelID.String(), time.Now().Unix())
+}
+
+// RemoveChannelID removes the record that a channel belongs to a guild.
+func (a *RedisMessageCacheStorageAdapter) RemoveChannelID(GuildID, ChannelID disgord.Snowflake) {
+	a.Client.HDel(a.ctx, a.guildChannelsKey(GuildID), ChannelID.String())
+}
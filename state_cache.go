@@ -0,0 +1,409 @@
+package gommand
+
+import (
+	"sync"
+
+	"github.com/andersfylling/disgord"
+)
+
+// StateStorageAdapter is the interface which is used by StateCacheHandler to store guild, channel,
+// member, role, voice state and emoji data derived from gateway events. This mirrors discordgo's
+// state.go and jonas747/dstate, but is pluggable like MessageCacheStorageAdapter.
+type StateStorageAdapter interface {
+	// Called when the router is created.
+	Init()
+
+	// Guild related.
+	GuildAdd(Guild *disgord.Guild)
+	GuildRemove(GuildID disgord.Snowflake)
+	Guild(GuildID disgord.Snowflake) *disgord.Guild
+
+	// Channel related.
+	ChannelUpsert(GuildID disgord.Snowflake, Channel *disgord.Channel)
+	ChannelRemove(GuildID, ChannelID disgord.Snowflake)
+	Channel(ChannelID disgord.Snowflake) *disgord.Channel
+	ChannelsInGuild(GuildID disgord.Snowflake) []*disgord.Channel
+	// ChannelPinTimestamp updates a cached channel's LastPinTimestamp in place, under the
+	// adapter's own lock. Callers must not mutate a *disgord.Channel returned by Channel directly.
+	ChannelPinTimestamp(ChannelID disgord.Snowflake, Timestamp disgord.Time)
+
+	// Role related.
+	RoleUpsert(GuildID disgord.Snowflake, Role *disgord.Role)
+	RoleRemove(GuildID, RoleID disgord.Snowflake)
+
+	// Member related.
+	MemberUpsert(GuildID disgord.Snowflake, Member *disgord.Member)
+	MemberRemove(GuildID, UserID disgord.Snowflake)
+	Member(GuildID, UserID disgord.Snowflake) *disgord.Member
+	MembersWithRole(GuildID, RoleID disgord.Snowflake) []*disgord.Member
+
+	// VoiceStateUpsert tracks a member's current voice channel. A ChannelID of 0 means the member
+	// left voice entirely, in which case the voice state is dropped.
+	VoiceStateUpsert(GuildID disgord.Snowflake, State *disgord.VoiceState)
+	// VoiceState returns a member's cached voice state, or nil if they aren't in voice.
+	VoiceState(GuildID, UserID disgord.Snowflake) *disgord.VoiceState
+
+	// EmojiUpsert replaces the full emoji list for a guild, as delivered by GUILD_EMOJIS_UPDATE.
+	EmojiUpsert(GuildID disgord.Snowflake, Emojis []*disgord.Emoji)
+
+	// PresenceUpsert tracks a member's current presence. Only called when WithPresences is enabled.
+	PresenceUpsert(GuildID disgord.Snowflake, Presence *disgord.PresenceUpdate)
+}
+
+// guildState is the data tracked per-guild by InMemoryStateStorageAdapter.
+type guildState struct {
+	Guild       *disgord.Guild
+	Channels    map[disgord.Snowflake]*disgord.Channel
+	Members     map[disgord.Snowflake]*disgord.Member
+	Presences   map[disgord.Snowflake]*disgord.PresenceUpdate
+	VoiceStates map[disgord.Snowflake]*disgord.VoiceState
+}
+
+// InMemoryStateStorageAdapter is the default StateStorageAdapter, keeping all state in memory
+// behind a single mutex. It's suitable for single-process bots; sharded bots running as separate
+// processes should use a shared backend instead.
+type InMemoryStateStorageAdapter struct {
+	mu     sync.RWMutex
+	guilds map[disgord.Snowflake]*guildState
+}
+
+// Init is called when the router is created.
+func (a *InMemoryStateStorageAdapter) Init() {
+	a.guilds = map[disgord.Snowflake]*guildState{}
+}
+
+func (a *InMemoryStateStorageAdapter) guildStateFor(GuildID disgord.Snowflake) *guildState {
+	g, ok := a.guilds[GuildID]
+	if !ok {
+		g = &guildState{
+			Channels:    map[disgord.Snowflake]*disgord.Channel{},
+			Members:     map[disgord.Snowflake]*disgord.Member{},
+			Presences:   map[disgord.Snowflake]*disgord.PresenceUpdate{},
+			VoiceStates: map[disgord.Snowflake]*disgord.VoiceState{},
+		}
+		a.guilds[GuildID] = g
+	}
+	return g
+}
+
+// GuildAdd adds or replaces a guild, along with the channels and members it was created with.
+func (a *InMemoryStateStorageAdapter) GuildAdd(Guild *disgord.Guild) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	g := a.guildStateFor(Guild.ID)
+	g.Guild = Guild
+	for _, c := range Guild.Channels {
+		g.Channels[c.ID] = c
+	}
+	for _, m := range Guild.Members {
+		g.Members[m.UserID] = m
+	}
+}
+
+// GuildRemove removes a guild and everything tracked under it.
+func (a *InMemoryStateStorageAdapter) GuildRemove(GuildID disgord.Snowflake) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.guilds, GuildID)
+}
+
+// Guild returns a cached guild, or nil if it isn't cached.
+func (a *InMemoryStateStorageAdapter) Guild(GuildID disgord.Snowflake) *disgord.Guild {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	g, ok := a.guilds[GuildID]
+	if !ok {
+		return nil
+	}
+	return g.Guild
+}
+
+// ChannelUpsert adds or replaces a channel.
+func (a *InMemoryStateStorageAdapter) ChannelUpsert(GuildID disgord.Snowflake, Channel *disgord.Channel) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.guildStateFor(GuildID).Channels[Channel.ID] = Channel
+}
+
+// ChannelRemove removes a channel from a guild.
+func (a *InMemoryStateStorageAdapter) ChannelRemove(GuildID, ChannelID disgord.Snowflake) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	g, ok := a.guilds[GuildID]
+	if !ok {
+		return
+	}
+	delete(g.Channels, ChannelID)
+}
+
+// Channel returns a copy of a cached channel from any guild, or nil if it isn't cached. A copy is
+// returned rather than the stored pointer so that callers can't race in-place mutators like
+// ChannelPinTimestamp; use ChannelUpsert/ChannelPinTimestamp to write instead.
+func (a *InMemoryStateStorageAdapter) Channel(ChannelID disgord.Snowflake) *disgord.Channel {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, g := range a.guilds {
+		if c, ok := g.Channels[ChannelID]; ok {
+			cp := *c
+			return &cp
+		}
+	}
+	return nil
+}
+
+// ChannelPinTimestamp updates a cached channel's LastPinTimestamp, under the adapter's own lock,
+// rather than leaving it to a caller to mutate a pointer returned by Channel.
+func (a *InMemoryStateStorageAdapter) ChannelPinTimestamp(ChannelID disgord.Snowflake, Timestamp disgord.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, g := range a.guilds {
+		if c, ok := g.Channels[ChannelID]; ok {
+			c.LastPinTimestamp = Timestamp
+			return
+		}
+	}
+}
+
+// ChannelsInGuild returns every cached channel belonging to a guild.
+func (a *InMemoryStateStorageAdapter) ChannelsInGuild(GuildID disgord.Snowflake) []*disgord.Channel {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	g, ok := a.guilds[GuildID]
+	if !ok {
+		return nil
+	}
+	out := make([]*disgord.Channel, 0, len(g.Channels))
+	for _, c := range g.Channels {
+		cp := *c
+		out = append(out, &cp)
+	}
+	return out
+}
+
+// RoleUpsert adds or replaces a role on the cached guild object.
+func (a *InMemoryStateStorageAdapter) RoleUpsert(GuildID disgord.Snowflake, Role *disgord.Role) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	g, ok := a.guilds[GuildID]
+	if !ok || g.Guild == nil {
+		return
+	}
+	for i, r := range g.Guild.Roles {
+		if r.ID == Role.ID {
+			g.Guild.Roles[i] = Role
+			return
+		}
+	}
+	g.Guild.Roles = append(g.Guild.Roles, Role)
+}
+
+// RoleRemove removes a role from the cached guild object.
+func (a *InMemoryStateStorageAdapter) RoleRemove(GuildID, RoleID disgord.Snowflake) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	g, ok := a.guilds[GuildID]
+	if !ok || g.Guild == nil {
+		return
+	}
+	for i, r := range g.Guild.Roles {
+		if r.ID == RoleID {
+			g.Guild.Roles = append(g.Guild.Roles[:i], g.Guild.Roles[i+1:]...)
+			return
+		}
+	}
+}
+
+// MemberUpsert adds or replaces a guild member.
+func (a *InMemoryStateStorageAdapter) MemberUpsert(GuildID disgord.Snowflake, Member *disgord.Member) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.guildStateFor(GuildID).Members[Member.UserID] = Member
+}
+
+// MemberRemove removes a guild member.
+func (a *InMemoryStateStorageAdapter) MemberRemove(GuildID, UserID disgord.Snowflake) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	g, ok := a.guilds[GuildID]
+	if !ok {
+		return
+	}
+	delete(g.Members, UserID)
+	delete(g.Presences, UserID)
+}
+
+// Member returns a copy of a cached guild member, or nil if they aren't cached. A copy is returned
+// rather than the stored pointer so that callers mutating the result (e.g. to fill in GuildID)
+// can't race MemberUpsert/MemberRemove or corrupt the cache.
+func (a *InMemoryStateStorageAdapter) Member(GuildID, UserID disgord.Snowflake) *disgord.Member {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	g, ok := a.guilds[GuildID]
+	if !ok {
+		return nil
+	}
+	m, ok := g.Members[UserID]
+	if !ok {
+		return nil
+	}
+	cp := *m
+	return &cp
+}
+
+// MembersWithRole returns every cached member of a guild which has the given role.
+func (a *InMemoryStateStorageAdapter) MembersWithRole(GuildID, RoleID disgord.Snowflake) []*disgord.Member {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	g, ok := a.guilds[GuildID]
+	if !ok {
+		return nil
+	}
+	out := make([]*disgord.Member, 0)
+	for _, m := range g.Members {
+		for _, r := range m.Roles {
+			if r == RoleID {
+				cp := *m
+				out = append(out, &cp)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// VoiceStateUpsert tracks a member's current voice state. A ChannelID of 0 means the member left
+// voice entirely, so the stored state is dropped instead of upserted.
+func (a *InMemoryStateStorageAdapter) VoiceStateUpsert(GuildID disgord.Snowflake, State *disgord.VoiceState) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if State.ChannelID == 0 {
+		if g, ok := a.guilds[GuildID]; ok {
+			delete(g.VoiceStates, State.UserID)
+		}
+		return
+	}
+	a.guildStateFor(GuildID).VoiceStates[State.UserID] = State
+}
+
+// VoiceState returns a copy of a member's cached voice state, or nil if they aren't in voice.
+func (a *InMemoryStateStorageAdapter) VoiceState(GuildID, UserID disgord.Snowflake) *disgord.VoiceState {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	g, ok := a.guilds[GuildID]
+	if !ok {
+		return nil
+	}
+	vs, ok := g.VoiceStates[UserID]
+	if !ok {
+		return nil
+	}
+	cp := *vs
+	return &cp
+}
+
+// EmojiUpsert replaces the emoji list on the cached guild object.
+func (a *InMemoryStateStorageAdapter) EmojiUpsert(GuildID disgord.Snowflake, Emojis []*disgord.Emoji) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	g, ok := a.guilds[GuildID]
+	if !ok || g.Guild == nil {
+		return
+	}
+	g.Guild.Emojis = Emojis
+}
+
+// PresenceUpsert tracks a member's current presence. Only called when WithPresences is enabled.
+func (a *InMemoryStateStorageAdapter) PresenceUpsert(GuildID disgord.Snowflake, Presence *disgord.PresenceUpdate) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.guildStateFor(GuildID).Presences[Presence.User.ID] = Presence
+}
+
+// StateCacheHandler hooks the gateway events needed to keep a StateStorageAdapter up to date.
+// It's installed by the router alongside MessageCacheHandler.
+type StateCacheHandler struct {
+	StateStorageAdapter StateStorageAdapter `json:"-"`
+
+	// WithPresences enables tracking presence updates, which are disabled by default since
+	// presence data dwarfs everything else in memory for large bots.
+	WithPresences bool `json:"withPresences"`
+}
+
+func (d *StateCacheHandler) guildCreate(_ disgord.Session, evt *disgord.GuildCreate) {
+	go d.StateStorageAdapter.GuildAdd(evt.Guild)
+}
+
+func (d *StateCacheHandler) guildDelete(_ disgord.Session, evt *disgord.GuildDelete) {
+	if evt.UnavailableGuild.Unavailable {
+		return
+	}
+	go d.StateStorageAdapter.GuildRemove(evt.UnavailableGuild.ID)
+}
+
+func (d *StateCacheHandler) channelCreate(_ disgord.Session, evt *disgord.ChannelCreate) {
+	go d.StateStorageAdapter.ChannelUpsert(evt.Channel.GuildID, evt.Channel)
+}
+
+func (d *StateCacheHandler) channelUpdate(_ disgord.Session, evt *disgord.ChannelUpdate) {
+	go d.StateStorageAdapter.ChannelUpsert(evt.Channel.GuildID, evt.Channel)
+}
+
+func (d *StateCacheHandler) channelDelete(_ disgord.Session, evt *disgord.ChannelDelete) {
+	go d.StateStorageAdapter.ChannelRemove(evt.Channel.GuildID, evt.Channel.ID)
+}
+
+func (d *StateCacheHandler) guildRoleCreate(_ disgord.Session, evt *disgord.GuildRoleCreate) {
+	go d.StateStorageAdapter.RoleUpsert(evt.GuildID, evt.Role)
+}
+
+func (d *StateCacheHandler) guildRoleUpdate(_ disgord.Session, evt *disgord.GuildRoleUpdate) {
+	go d.StateStorageAdapter.RoleUpsert(evt.GuildID, evt.Role)
+}
+
+func (d *StateCacheHandler) guildRoleDelete(_ disgord.Session, evt *disgord.GuildRoleDelete) {
+	go d.StateStorageAdapter.RoleRemove(evt.GuildID, evt.RoleID)
+}
+
+func (d *StateCacheHandler) guildMemberAdd(_ disgord.Session, evt *disgord.GuildMemberAdd) {
+	go d.StateStorageAdapter.MemberUpsert(evt.Member.GuildID, evt.Member)
+}
+
+func (d *StateCacheHandler) guildMemberUpdate(_ disgord.Session, evt *disgord.GuildMemberUpdate) {
+	go d.StateStorageAdapter.MemberUpsert(evt.GuildID, &disgord.Member{
+		GuildID:      evt.GuildID,
+		User:         evt.User,
+		Nick:         evt.Nick,
+		Roles:        evt.Roles,
+		JoinedAt:     evt.JoinedAt,
+		PremiumSince: evt.PremiumSince,
+	})
+}
+
+func (d *StateCacheHandler) guildMemberRemove(_ disgord.Session, evt *disgord.GuildMemberRemove) {
+	go d.StateStorageAdapter.MemberRemove(evt.GuildID, evt.User.ID)
+}
+
+// guildMembersChunk populates the cache with the bulk member data Discord sends at startup for
+// large guilds requested via RequestGuildMembers.
+func (d *StateCacheHandler) guildMembersChunk(_ disgord.Session, evt *disgord.GuildMembersChunk) {
+	go func() {
+		for _, m := range evt.Members {
+			d.StateStorageAdapter.MemberUpsert(evt.GuildID, m)
+		}
+	}()
+}
+
+func (d *StateCacheHandler) voiceStateUpdate(_ disgord.Session, evt *disgord.VoiceStateUpdate) {
+	go d.StateStorageAdapter.VoiceStateUpsert(evt.GuildID, evt.VoiceState)
+}
+
+func (d *StateCacheHandler) guildEmojisUpdate(_ disgord.Session, evt *disgord.GuildEmojisUpdate) {
+	go d.StateStorageAdapter.EmojiUpsert(evt.GuildID, evt.Emojis)
+}
+
+func (d *StateCacheHandler) presenceUpdate(_ disgord.Session, evt *disgord.PresenceUpdate) {
+	if !d.WithPresences {
+		return
+	}
+	go d.StateStorageAdapter.PresenceUpsert(evt.GuildID, evt)
+}